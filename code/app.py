@@ -2,20 +2,49 @@
 eventlet.monkey_patch()  # eventlet 패치를 맨 위에 추가
 
 import base64
+import hashlib
+import hmac
 import main
 import logging
+import re
+import secrets
 import signal
 import sys
 import threading
 from dataclasses import dataclass
-from typing import Dict
+from typing import Dict, List, Optional, Tuple, Union
 import os
 import socketio
-from flask import Flask, send_from_directory
+from flask import Flask, send_from_directory, jsonify, request
 
 # Initialize logging
-logging.basicConfig(level=logging.INFO)
+# 알 수 없는 LOG_LEVEL 이면 import 중에 ValueError 로 죽지 않도록 INFO 로 시작하고, self_check 에서 보고
+LOG_LEVEL = os.environ.get('LOG_LEVEL', 'INFO').upper()
+LOG_LEVEL_VALID = LOG_LEVEL in logging.getLevelNamesMapping()
+logging.basicConfig(level=LOG_LEVEL if LOG_LEVEL_VALID else 'INFO')
 logger = logging.getLogger(__name__)
+if not LOG_LEVEL_VALID:
+    logger.warning(f"Unknown LOG_LEVEL '{LOG_LEVEL}', using INFO")
+
+# LOG_PAYLOADS=1 이고 로그 레벨이 DEBUG 이면 수신한 이벤트 내용을 기록 (이미지/인증 값은 가림)
+LOG_PAYLOADS = os.environ.get('LOG_PAYLOADS', '0') == '1'
+IMAGE_FIELDS = {'image', 'end_frame', 'end_img1', 'end_img2', 'composited_image'}
+SECRET_FIELDS = {'token', 'auth', 'password', 'key'}
+
+# 방 ID 형식 (영문, 숫자, '-', '_' 1~64자)
+ROOM_ID_PATTERN = re.compile(r'[A-Za-z0-9_-]{1,64}')
+# Socket.IO 에서 방 이름 앞에 붙이는 접두사. 각 sid 도 같은 이름의 개인 방이므로 방 ID 가 sid 와 겹치지 않게 구분
+ROOM_PREFIX = 'room:'
+
+# /admin/* 요청에 필요한 토큰 (X-Admin-Token 헤더). 비어 있으면 관리자 API 비활성화
+ADMIN_TOKEN = os.environ.get('ADMIN_TOKEN', '')
+
+# 결과 이미지 전송 형식: raw(base64), dataURI(data:<형식>;base64,...), binary(바이트)
+OUTPUT_ENCODINGS = ('raw', 'dataURI', 'binary')
+OUTPUT_FORMATS = ('image/jpeg', 'image/webp')  # accept 로 협상 가능한 결과 이미지 형식
+
+# 연결당 최대 명령 수 (0 이면 제한 없음). 초과 시 연결 종료
+MAX_MESSAGES_PER_CONNECTION = int(os.environ.get('MAX_MESSAGES_PER_CONNECTION', '0'))
 
 # Define client roles
 class ClientRole:
@@ -28,10 +57,16 @@ class InputMessage:
     image: str
     filter_number: int
     people_count: int
+    progressive: Optional[bool] = None  # None 이면 서버 기본값(JPEG_PROGRESSIVE) 사용
+    accept: Optional[List[str]] = None  # 클라이언트가 표시할 수 있는 결과 이미지 형식
+    max_pixels: Optional[int] = None  # 결과 이미지 최대 픽셀 수 (가로 x 세로)
+    timings: Optional[bool] = None  # None 이면 서버 기본값(REPORT_TIMINGS) 사용
 
 @dataclass
 class OutputMessage:
-    image: str
+    image: Union[str, bytes]
+    content_type: str = 'image/jpeg'
+    timings: Optional[Dict[str, float]] = None  # 단계별 소요 시간 (ms)
 
 # Define EndMessage structure for "end" event
 @dataclass
@@ -52,6 +87,12 @@ class Hub:
         self.people_count: int = 1
         self.input_image_data: str = ""
         self.output_image_data: str = ""
+        self.message_counts: Dict[str, int] = {}  # sid -> 처리한 명령 수
+        self.message_limit_disconnects: int = 0
+        self.draining: bool = False  # True 이면 사진 저장/합성 같은 쓰기 요청 거부
+        self.rooms: Dict[str, str] = {}  # sid -> room_id (연결당 하나의 방)
+        self.room_keys: Dict[str, str] = {}  # room_id -> 참여 키 (등록된 클라이언트가 방을 열 때 발급)
+        self.member_ids: Dict[str, str] = {}  # sid -> 방 안에서 쓰는 참여자 ID (presence 에 sid 대신 노출)
         self.lock = threading.Lock()
 
     def register_client(self, role: str, sid: str, sio: socketio.Server):
@@ -66,12 +107,68 @@ class Hub:
 
     def unregister_client(self, sid: str):
         with self.lock:
+            self.message_counts.pop(sid, None)
             for role, client_sid in list(self.clients.items()):
                 if client_sid == sid:
                     del self.clients[role]
                     logger.info(f"Client disconnected: Role '{role}', SID {sid}")
                     break
 
+    def open_room(self, room_id: str) -> str:
+        # 방의 참여 키 반환. 아직 열리지 않은 방이면 새로 발급
+        with self.lock:
+            if room_id not in self.room_keys:
+                self.room_keys[room_id] = secrets.token_urlsafe(16)
+                logger.info(f"Room '{room_id}' opened")
+            return self.room_keys[room_id]
+
+    def check_room_key(self, room_id: str, key: str) -> bool:
+        with self.lock:
+            room_key = self.room_keys.get(room_id)
+        return room_key is not None and hmac.compare_digest(key.encode(), room_key.encode())
+
+    def _close_room_if_empty(self, room_id: str):
+        # self.lock 을 잡은 상태에서 호출. 마지막 참여자가 나가면 참여 키 폐기
+        if room_id not in self.rooms.values() and self.room_keys.pop(room_id, None):
+            logger.info(f"Room '{room_id}' closed")
+
+    def join_room(self, sid: str, room_id: str) -> Tuple[Optional[str], Optional[str], str]:
+        # (이전 방 ID, 이전 방의 참여자 ID, 이 방의 참여자 ID) 반환. 방을 옮길 때마다 참여자 ID 새로 발급
+        with self.lock:
+            previous_room = self.rooms.get(sid)
+            previous_member_id = self.member_ids.get(sid)
+            if previous_room != room_id:
+                self.member_ids[sid] = secrets.token_hex(4)
+            self.rooms[sid] = room_id
+            logger.info(f"SID {sid} joined room '{room_id}'")
+            if previous_room and previous_room != room_id:
+                self._close_room_if_empty(previous_room)
+            return previous_room, previous_member_id, self.member_ids[sid]
+
+    def leave_room(self, sid: str) -> Tuple[Optional[str], Optional[str]]:
+        # (방 ID, 참여자 ID) 반환
+        with self.lock:
+            room_id = self.rooms.pop(sid, None)
+            member_id = self.member_ids.pop(sid, None)
+            if room_id:
+                logger.info(f"SID {sid} left room '{room_id}'")
+                self._close_room_if_empty(room_id)
+            return room_id, member_id
+
+    def get_room(self, sid: str) -> Optional[str]:
+        with self.lock:
+            return self.rooms.get(sid)
+
+    def set_draining(self, draining: bool):
+        with self.lock:
+            self.draining = draining
+            logger.info(f"Drain mode {'enabled' if draining else 'disabled'}.")
+
+    def count_message(self, sid: str) -> int:
+        with self.lock:
+            self.message_counts[sid] = self.message_counts.get(sid, 0) + 1
+            return self.message_counts[sid]
+
     def get_client_sid(self, role: str) -> str:
         with self.lock:
             return self.clients.get(role, "")
@@ -111,6 +208,47 @@ app.wsgi_app = socketio.WSGIApp(sio, app.wsgi_app)
 # Initialize Hub
 hub = Hub()
 
+# 연결당 명령 수를 세고, 제한을 넘으면 연결을 끊음 (False 반환 시 핸들러 중단)
+def check_message_limit(sid):
+    count = hub.count_message(sid)
+    if MAX_MESSAGES_PER_CONNECTION and count > MAX_MESSAGES_PER_CONNECTION:
+        logger.warning(f"SID {sid} exceeded the message limit ({MAX_MESSAGES_PER_CONNECTION}). Disconnecting.")
+        with hub.lock:
+            hub.message_limit_disconnects += 1
+        sio.emit('error', {'message': 'Message limit exceeded. Please reconnect.'}, to=sid)
+        sio.disconnect(sid)
+        return False
+    return True
+
+# 이미지 문자열/바이트는 길이와 해시로만 표시
+def redact_value(value):
+    if isinstance(value, str):
+        return f"<{len(value)} chars, sha256:{hashlib.sha256(value.encode('utf-8')).hexdigest()[:12]}>"
+    if isinstance(value, bytes):
+        return f"<{len(value)} bytes, sha256:{hashlib.sha256(value).hexdigest()[:12]}>"
+    return value
+
+
+def redact_payload(data):
+    if isinstance(data, (str, bytes)):  # 'image', 'result' 는 base64 문자열을 그대로 전송
+        return redact_value(data)
+    if isinstance(data, dict):
+        redacted = {}
+        for key, value in data.items():
+            if key in SECRET_FIELDS:
+                redacted[key] = '<redacted>'
+            elif key in IMAGE_FIELDS:
+                redacted[key] = redact_value(value)
+            else:
+                redacted[key] = value
+        return redacted
+    return data
+
+
+def log_payload(event, sid, data):
+    if LOG_PAYLOADS and logger.isEnabledFor(logging.DEBUG):
+        logger.debug(f"Payload of '{event}' from SID {sid}: {redact_payload(data)}")
+
 # Socket.IO event handlers
 @sio.event
 def connect(sid, environ):
@@ -118,11 +256,83 @@ def connect(sid, environ):
 
 @sio.event
 def disconnect(sid):
+    # Socket.IO 가 방에서는 자동으로 빼주므로 남은 참여자에게 알림만 전송
+    room_id, member_id = hub.leave_room(sid)
+    if room_id:
+        sio.emit('presence', {'room_id': room_id, 'member_id': member_id, 'status': 'left'}, to=ROOM_PREFIX + room_id, skip_sid=sid)
     hub.unregister_client(sid)
     logger.info(f"Disconnected: SID {sid}")
 
+# 방 참여. 같은 방의 다른 연결에게 참여 알림을 보내고, 이후 처리된 이미지를 함께 받음
+# 등록된 클라이언트(monitor, lapa)는 키 없이 방을 열고 'joined' 로 참여 키를 받음. 그 외 연결은 그 키가 있어야 참여 가능
+@sio.event
+def join(sid, data):
+    logger.info(f"Received 'join' event from SID {sid}")
+    if not check_message_limit(sid):
+        return
+    log_payload('join', sid, data)
+
+    # 데이터 검증
+    room_id = data.get('room_id') if isinstance(data, dict) else None
+    if not isinstance(room_id, str) or not ROOM_ID_PATTERN.fullmatch(room_id):
+        logger.error(f"Invalid room_id from SID {sid}: {room_id}")
+        sio.emit('error', {'message': "Invalid room_id. Use 1-64 letters, digits, '-' or '_'."}, to=sid)
+        return
+
+    # 역할 확인
+    sender_role = None
+    with hub.lock:
+        for role, client_sid in hub.clients.items():
+            if client_sid == sid:
+                sender_role = role
+                break
+
+    joined = {'room_id': room_id}
+    if sender_role:
+        joined['key'] = hub.open_room(room_id)
+    else:
+        key = data.get('key')
+        if not isinstance(key, str) or not hub.check_room_key(room_id, key):
+            logger.warning(f"Rejected 'join' of room '{room_id}' from SID {sid}: missing or wrong room key")
+            sio.emit('error', {'message': 'Invalid room key'}, to=sid)
+            return
+
+    previous_room, previous_member_id, member_id = hub.join_room(sid, room_id)
+    joined['member_id'] = member_id
+    if previous_room == room_id:
+        sio.emit('joined', joined, to=sid)
+        return
+    if previous_room:
+        sio.leave_room(sid, ROOM_PREFIX + previous_room)
+        sio.emit('presence', {'room_id': previous_room, 'member_id': previous_member_id, 'status': 'left'}, to=ROOM_PREFIX + previous_room, skip_sid=sid)
+
+    sio.enter_room(sid, ROOM_PREFIX + room_id)
+    sio.emit('joined', joined, to=sid)
+    sio.emit('presence', {'room_id': room_id, 'member_id': member_id, 'status': 'joined'}, to=ROOM_PREFIX + room_id, skip_sid=sid)
+
+# 방 나가기
+@sio.event
+def leave(sid, data=None):
+    logger.info(f"Received 'leave' event from SID {sid}")
+    if not check_message_limit(sid):
+        return
+    log_payload('leave', sid, data)
+
+    room_id, member_id = hub.leave_room(sid)
+    if not room_id:
+        sio.emit('error', {'message': 'Not in a room'}, to=sid)
+        return
+
+    sio.leave_room(sid, ROOM_PREFIX + room_id)
+    sio.emit('left', {'room_id': room_id}, to=sid)
+    sio.emit('presence', {'room_id': room_id, 'member_id': member_id, 'status': 'left'}, to=ROOM_PREFIX + room_id, skip_sid=sid)
+
 @sio.event
 def register(sid, data):
+    if not check_message_limit(sid):
+        return
+    log_payload('register', sid, data)
+
     role = data.get('role')
     if role not in [ClientRole.MONITOR, ClientRole.LAPA]:
         logger.warning(f"Invalid role registration attempt: '{role}' by SID {sid}")
@@ -133,10 +343,65 @@ def register(sid, data):
     sio.emit('registered', {'role': role}, to=sid)
     logger.info(f"Client registered with role '{role}': SID {sid}")
 
+# 서버가 지원하는 출력 옵션 조회
+@sio.event
+def capabilities(sid, data=None):
+    logger.info(f"Received 'capabilities' event from SID {sid}")
+    if not check_message_limit(sid):
+        return
+    log_payload('capabilities', sid, data)
+    sio.emit('capabilities', {
+        'progressive_jpeg': main.progressive_jpeg_supported(),
+        'progressive_jpeg_default': main.JPEG_PROGRESSIVE,
+        'allowed_content_types': main.ALLOWED_CONTENT_TYPES,
+        'output_encodings': list(OUTPUT_ENCODINGS),
+        'output_formats': list(OUTPUT_FORMATS)
+    }, to=sid)
+
+# 입력 이미지를 필터 처리/저장 없이 검사만 수행 ('image', 'result' 와 같은 역할 확인 포함)
+# draining 이 True 이면 'result' 는 거부되므로 함께 알려줌
+@sio.event
+def validate(sid, data):
+    logger.info(f"Received 'validate' event from SID {sid}")
+    if not check_message_limit(sid):
+        return
+    log_payload('validate', sid, data)
+
+    # 역할 확인
+    sender_role = None
+    with hub.lock:
+        for role, client_sid in hub.clients.items():
+            if client_sid == sid:
+                sender_role = role
+                break
+
+    if not sender_role:
+        logger.warning(f"'validate' event from unregistered client: SID {sid}")
+        sio.emit('validated', {'valid': False, 'reason': 'Role not registered', 'draining': hub.draining}, to=sid)
+        return
+
+    if sender_role != ClientRole.MONITOR:
+        logger.warning(f"Unauthorized 'validate' event from role '{sender_role}' (SID {sid})")
+        sio.emit('validated', {'valid': False, 'reason': 'Unauthorized event', 'draining': hub.draining}, to=sid)
+        return
+
+    image_str = data.get('image') if isinstance(data, dict) else data
+    if not isinstance(image_str, str):
+        logger.error("Invalid image data format.")
+        sio.emit('validated', {'valid': False, 'reason': 'Invalid image data', 'draining': hub.draining}, to=sid)
+        return
+
+    result = main.validate_input_image(image_str)
+    result['draining'] = hub.draining
+    sio.emit('validated', result, to=sid)
+
 # 새로운 "image" 이벤트 핸들러 추가
 @sio.event
 def image(sid, data):
     logger.info(f"Received 'image' event from SID {sid}")
+    if not check_message_limit(sid):
+        return
+    log_payload('image', sid, data)
 
     # 역할 확인
     sender_role = None
@@ -156,11 +421,47 @@ def image(sid, data):
         sio.emit('error', {'message': 'Unauthorized event'}, to=sid)
         return
 
-    image_str = data  # 클라이언트에서 단순히 base64 문자열을 전송
+    # 클라이언트는 base64 문자열 또는
+    # {'image': ..., 'progressive': bool, 'encoding': str, 'accept': [형식, ...], 'max_pixels': int,
+    #  'timings': bool} 형태로 전송
+    progressive = None
+    encoding = 'raw'
+    accept = None
+    max_pixels = None
+    timings = None
+    if isinstance(data, dict):
+        image_str = data.get('image')
+        progressive = data.get('progressive')
+        encoding = data.get('encoding', 'raw')
+        accept = data.get('accept')
+        max_pixels = data.get('max_pixels')
+        timings = data.get('timings')
+    else:
+        image_str = data
     if not isinstance(image_str, str):
         logger.error("Invalid image data format.")
         sio.emit('error', {'message': 'Invalid image data'}, to=sid)
         return
+    if progressive is not None and not isinstance(progressive, bool):
+        logger.error("Invalid progressive flag. Must be a boolean.")
+        sio.emit('error', {'message': 'Invalid progressive flag. Must be a boolean.'}, to=sid)
+        return
+    if encoding not in OUTPUT_ENCODINGS:
+        logger.error(f"Invalid output encoding: {encoding}")
+        sio.emit('error', {'message': f"Invalid encoding. Must be one of: {', '.join(OUTPUT_ENCODINGS)}"}, to=sid)
+        return
+    if accept is not None and (not isinstance(accept, list) or not all(isinstance(f, str) for f in accept)):
+        logger.error("Invalid accept list. Must be a list of content types.")
+        sio.emit('error', {'message': 'Invalid accept list. Must be a list of content types.'}, to=sid)
+        return
+    if max_pixels is not None and (not isinstance(max_pixels, int) or isinstance(max_pixels, bool) or max_pixels < 1):
+        logger.error("Invalid max_pixels. Must be a positive integer.")
+        sio.emit('error', {'message': 'Invalid max_pixels. Must be a positive integer.'}, to=sid)
+        return
+    if timings is not None and not isinstance(timings, bool):
+        logger.error("Invalid timings flag. Must be a boolean.")
+        sio.emit('error', {'message': 'Invalid timings flag. Must be a boolean.'}, to=sid)
+        return
 
     hub.set_input_image_data(image_str)
 
@@ -170,13 +471,21 @@ def image(sid, data):
     input_msg = InputMessage(
         image=hub.input_image_data,
         filter_number=hub.filter_number,
-        people_count=hub.people_count
+        people_count=hub.people_count,
+        progressive=progressive,
+        accept=accept,
+        max_pixels=max_pixels,
+        timings=timings
     )
 
 
-    image_ai = main.input(input_msg.__dict__, False)
+    try:
+        image_ai, content_type, timings = main.input(input_msg.__dict__, False)
+    except main.ImageRejectedError as e:
+        sio.emit('error', {'message': str(e)}, to=sid)
+        return
 
-    output(image_ai)
+    output(image_ai, encoding, content_type, timings)
     '''
     ai_sid = hub.get_client_sid(ClientRole.AI)
     if ai_sid:
@@ -187,10 +496,9 @@ def image(sid, data):
     '''
 # 새로운 "output" 이벤트 핸들러 추가
 
-def output(data):
+def output(data, encoding='raw', content_type='image/jpeg', timings=None):
     sid = 'ai'
     image_str = data  # 클라이언트에서 단순히 base64 문자열을 전송
-    logger.info(image_str)
     if not isinstance(image_str, str):
         logger.error("Invalid output image data format.")
         sio.emit('error', {'message': 'Invalid output data'}, to=sid)
@@ -199,9 +507,24 @@ def output(data):
     hub.set_output_image_data(image_str)
     monitor_sid = hub.get_client_sid(ClientRole.MONITOR)
     if monitor_sid:
-        output_msg = OutputMessage(image=image_str)
-        sio.emit('image', output_msg.__dict__, to=monitor_sid)
+        if encoding == 'dataURI':
+            output_msg = OutputMessage(image=f"data:{content_type};base64,{image_str}", content_type=content_type)
+        elif encoding == 'binary':
+            output_msg = OutputMessage(image=base64.b64decode(image_str), content_type=content_type)
+        else:
+            output_msg = OutputMessage(image=image_str, content_type=content_type)
+        if timings is not None:
+            output_msg.timings = timings
+        # timings 를 요청하지 않았으면 응답에서 생략
+        payload = {key: value for key, value in output_msg.__dict__.items() if value is not None}
+        sio.emit('image', payload, to=monitor_sid)
         logger.info("Sent 'image' event to Monitor client.")
+
+        # 모니터가 방에 참여 중이면 같은 방의 다른 연결에도 처리된 이미지 전송
+        room_id = hub.get_room(monitor_sid)
+        if room_id:
+            sio.emit('image', dict(payload, room_id=room_id), to=ROOM_PREFIX + room_id, skip_sid=monitor_sid)
+            logger.info(f"Broadcast 'image' event to room '{room_id}'.")
     else:
         logger.warning("Monitor client is not connected.")
 
@@ -209,6 +532,9 @@ def output(data):
 @sio.event
 def filter(sid, data):
     logger.info(f"Received 'filter' event from SID {sid}: {data}")
+    if not check_message_limit(sid):
+        return
+    log_payload('filter', sid, data)
 
     # 역할 확인
     sender_role = None
@@ -250,6 +576,9 @@ def filter(sid, data):
 @sio.event
 def people(sid, data):
     logger.info(f"Received 'people' event from SID {sid}: {data}")
+    if not check_message_limit(sid):
+        return
+    log_payload('people', sid, data)
 
     # 역할 확인
     sender_role = None
@@ -287,6 +616,55 @@ def people(sid, data):
     sio.emit('people_count_set', {'people_count': people_count}, to=sid)
     logger.info(f"People count set to {people_count} by SID {sid}")
 
+# 결과 사진 다운로드 URL 을 담은 QR 코드 생성
+@sio.event
+def qrcode(sid, data=None):
+    logger.info(f"Received 'qrcode' event from SID {sid}: {data}")
+    if not check_message_limit(sid):
+        return
+    log_payload('qrcode', sid, data)
+
+    # 역할 확인
+    sender_role = None
+    with hub.lock:
+        for role, client_sid in hub.clients.items():
+            if client_sid == sid:
+                sender_role = role
+                break
+
+    if sender_role not in [ClientRole.MONITOR, ClientRole.LAPA]:
+        logger.warning(f"Unauthorized 'qrcode' event from role '{sender_role}' (SID {sid})")
+        sio.emit('error', {'message': 'Unauthorized event'}, to=sid)
+        return
+
+    # 데이터 검증
+    options = data if isinstance(data, dict) else {}
+    box_size = options.get('box_size', 10)
+    error_correction = options.get('error_correction', 'L')
+    if not isinstance(box_size, int) or isinstance(box_size, bool) or not 1 <= box_size <= 40:
+        logger.error("Invalid box_size. Must be an integer between 1 and 40.")
+        sio.emit('error', {'message': 'Invalid box_size. Must be an integer between 1 and 40.'}, to=sid)
+        return
+    if not isinstance(error_correction, str) or error_correction not in main.QR_ERROR_CORRECTION:
+        logger.error(f"Invalid error_correction: {error_correction}")
+        sio.emit('error', {'message': 'Invalid error_correction. Must be one of: L, M, Q, H'}, to=sid)
+        return
+
+    if not main.PUBLIC_BASE_URL:
+        logger.error("PUBLIC_BASE_URL is not configured. The result image has no public URL.")
+        sio.emit('error', {'message': 'The result image has no public URL (PUBLIC_BASE_URL is not configured).'}, to=sid)
+        return
+    token = main.latest_result_token
+    if token is None or main.find_result_shot(token) is None:
+        logger.error("No result image has been saved yet, or it has expired.")
+        sio.emit('error', {'message': 'No result image has been saved yet, or it has expired.'}, to=sid)
+        return
+
+    url = f"{main.PUBLIC_BASE_URL}/result/{token}"
+    qr_png = main.make_url_qr(url, box_size, error_correction)
+    sio.emit('qrcode', {'url': url, 'image': base64.b64encode(qr_png).decode('utf-8')}, to=sid)
+    logger.info(f"Sent 'qrcode' event to SID {sid} for {url}")
+
 # 새로운 "trigger_end" 이벤트 핸들러 추가
 @sio.event
 def trigger_end(sid, data):
@@ -294,7 +672,14 @@ def trigger_end(sid, data):
     This event can be emitted by a client (e.g., Monitor) to request the server to send
     the 'end' event to the AI client with three image strings.
     """
-    logger.info(f"Received 'trigger_end' event from SID {sid}: {data}")
+    logger.info(f"Received 'trigger_end' event from SID {sid}")
+    if not check_message_limit(sid):
+        return
+    log_payload('trigger_end', sid, data)
+    if hub.draining:
+        logger.warning(f"Rejected 'trigger_end' from SID {sid}: server draining")
+        sio.emit('error', {'message': 'Server draining. Please retry on another server.'}, to=sid)
+        return
 
     # 역할 확인
     sender_role = None
@@ -372,6 +757,13 @@ def save_base64_image(image_base64, output_dir, output_file):
 @sio.event
 def result(sid, data):
     logger.info(f"Received 'result' event from SID {sid}")
+    if not check_message_limit(sid):
+        return
+    log_payload('result', sid, data)
+    if hub.draining:
+        logger.warning(f"Rejected 'result' from SID {sid}: server draining")
+        sio.emit('error', {'message': 'Server draining. Please retry on another server.'}, to=sid)
+        return
 
     # 역할 확인
     sender_role = None
@@ -406,7 +798,11 @@ def result(sid, data):
     )
 
 
-    main.input(input_msg.__dict__, True)
+    try:
+        main.input(input_msg.__dict__, True)
+    except main.ImageRejectedError as e:
+        sio.emit('error', {'message': str(e)}, to=sid)
+        return
 
     '''
     output_directory = r"C:\/Users\kyle0\Desktop\/ai-together-backend_new\/res_img"
@@ -474,7 +870,7 @@ def end(sid, data):
     It expects a composited image and forwards it to the Monitor client.
     """
     sid = 'ai'
-    logger.info(f"Received 'end' event from SID {sid}: {data}")
+    logger.info(f"Received 'end' event from SID {sid}: {redact_payload(data)}")
 
 
     # 데이터 검증
@@ -501,6 +897,51 @@ def end(sid, data):
     else:
         logger.warning("Monitor client is not connected. Cannot send 'end_composited' event.")
 
+# 운영 지표 조회
+@app.route('/metrics')
+def metrics():
+    # 세션 ID 가 노출되지 않도록 연결별 값 대신 합계만 보고
+    with hub.lock:
+        counts = list(hub.message_counts.values())
+        return jsonify({
+            'max_messages_per_connection': MAX_MESSAGES_PER_CONNECTION,
+            'connections': len(counts),
+            'max_message_count': max(counts, default=0),
+            'message_limit_disconnects': hub.message_limit_disconnects,
+            'transform_queue_capacity': main.TRANSFORM_QUEUE_CAPACITY,
+            'transform_queue': main.get_transform_stats()
+        })
+
+# 상태 확인. 드레인 중이면 503 으로 응답해 로드밸런서가 새 요청을 다른 서버로 보내도록 함
+@app.route('/healthz')
+def healthz():
+    if hub.draining:
+        return jsonify({'status': 'draining', 'ready': False}), 503
+    return jsonify({'status': 'ok', 'ready': True})
+
+# 드레인 모드 시작(POST) / 해제(DELETE)
+@app.route('/admin/drain', methods=['POST', 'DELETE'])
+def admin_drain():
+    if not ADMIN_TOKEN:
+        return jsonify({'error': 'Admin API is disabled'}), 404
+    if not hmac.compare_digest(request.headers.get('X-Admin-Token', '').encode(), ADMIN_TOKEN.encode()):
+        return jsonify({'error': 'Unauthorized'}), 401
+
+    hub.set_draining(request.method == 'POST')
+    return jsonify({'draining': hub.draining})
+
+# 결과 사진 다운로드 (QR 코드가 가리키는 촬영별 주소)
+@app.route('/result/<token>')
+def result_image(token):
+    # 공개 주소를 설정하지 않았으면 결과 사진을 외부에 노출하지 않음
+    if not main.PUBLIC_BASE_URL:
+        return jsonify({'error': 'Not found'}), 404
+    shot_path = main.find_result_shot(token)
+    if shot_path is None:
+        return jsonify({'error': 'Not found'}), 404
+    shot_path = os.path.abspath(shot_path)
+    return send_from_directory(os.path.dirname(shot_path), os.path.basename(shot_path))
+
 # Serve static files from the "public" directory
 @app.route('/')
 def index():
@@ -562,7 +1003,63 @@ def shutdown_server(signum, frame):
         app.run(debug=True)
 
 
+# 시작 전 환경 점검. 문제 목록을 반환 (비어 있으면 통과)
+def self_check():
+    problems = []
+
+    if not LOG_LEVEL_VALID:
+        problems.append(f"LOG_LEVEL must be one of {', '.join(logging.getLevelNamesMapping())} (got {LOG_LEVEL})")
+
+    if not os.path.isdir(main.FILTER_DIRECTORY):
+        problems.append(f"Filter directory does not exist: {main.FILTER_DIRECTORY}")
+
+    result_dir = os.path.dirname(os.path.abspath(main.RESULT_IMAGE_PATH))
+    if not os.path.isdir(result_dir):
+        problems.append(f"Result image directory does not exist: {result_dir}")
+    elif not os.access(result_dir, os.W_OK):
+        problems.append(f"Result image directory is not writable: {result_dir}")
+
+    known_types = {'image/jpeg', 'image/png', 'image/webp', 'image/gif', 'image/bmp', 'image/tiff'}
+    if not main.ALLOWED_CONTENT_TYPES:
+        problems.append("ALLOWED_CONTENT_TYPES is empty; no input image would be accepted")
+    for content_type in main.ALLOWED_CONTENT_TYPES:
+        if content_type not in known_types:
+            problems.append(f"ALLOWED_CONTENT_TYPES contains unknown type: {content_type}")
+
+    if main.RESULT_MAX_PIXELS < 0:
+        problems.append(f"RESULT_MAX_PIXELS must not be negative (got {main.RESULT_MAX_PIXELS})")
+
+    if main.RESULT_SHOT_TTL < 1:
+        problems.append(f"RESULT_SHOT_TTL must be at least 1 second (got {main.RESULT_SHOT_TTL})")
+
+    if not 1 <= main.WEBP_QUALITY <= 100:
+        problems.append(f"WEBP_QUALITY must be between 1 and 100 (got {main.WEBP_QUALITY})")
+
+    if main.TRANSFORM_CONCURRENCY < 1:
+        problems.append(f"TRANSFORM_CONCURRENCY must be at least 1 (got {main.TRANSFORM_CONCURRENCY})")
+    if main.TRANSFORM_QUEUE_CAPACITY < 0:
+        problems.append(f"TRANSFORM_QUEUE_CAPACITY must not be negative (got {main.TRANSFORM_QUEUE_CAPACITY})")
+    if main.TRANSFORM_QUEUE_TIMEOUT <= 0:
+        problems.append(f"TRANSFORM_QUEUE_TIMEOUT must be positive (got {main.TRANSFORM_QUEUE_TIMEOUT})")
+    if main.UPLOAD_BANDWIDTH_LIMIT < 0:
+        problems.append(f"UPLOAD_BANDWIDTH_LIMIT must not be negative (got {main.UPLOAD_BANDWIDTH_LIMIT})")
+    if main.UPLOAD_BANDWIDTH_LIMIT and main.UPLOAD_BANDWIDTH_TIMEOUT <= 0:
+        problems.append(f"UPLOAD_BANDWIDTH_TIMEOUT must be positive (got {main.UPLOAD_BANDWIDTH_TIMEOUT})")
+    if MAX_MESSAGES_PER_CONNECTION < 0:
+        problems.append(f"MAX_MESSAGES_PER_CONNECTION must not be negative (got {MAX_MESSAGES_PER_CONNECTION})")
+
+    return problems
+
+
 if __name__ == '__main__':
+    # 환경 점검을 통과해야만 서버를 시작
+    problems = self_check()
+    if problems:
+        for problem in problems:
+            logger.error(f"Self-check failed: {problem}")
+        sys.exit(1)
+    logger.info("Self-check passed.")
+
     # Handle graceful shutdown
     signal.signal(signal.SIGINT, shutdown_server)
     signal.signal(signal.SIGTERM, shutdown_server)
@@ -6,10 +6,19 @@ import numpy as np
 import math
 import picture
 import base64
+from io import BytesIO
+import binascii
 import asyncio
 import logging
 from concurrent.futures import ThreadPoolExecutor
+from contextlib import contextmanager
+from eventlet import patcher, tpool
 import os
+import re
+import secrets
+import shutil
+import threading
+import time
 import temp
 import app
 
@@ -25,6 +34,442 @@ face_mesh = mp_face_mesh.FaceMesh(
 # 쓰레드 풀
 executor = ThreadPoolExecutor(max_workers=4)  # 이미지 처리를 위한 스레드 풀
 
+# 필터 이미지 디렉토리와 결과 사진 저장 경로
+FILTER_DIRECTORY = os.environ.get(
+    'FILTER_DIRECTORY', r'C:\Users\kyle0\Desktop\trick-or-picture-main\trick-or-picture-main\img'
+)
+RESULT_IMAGE_PATH = os.environ.get('RESULT_IMAGE_PATH', r'../res_img/res.png')
+# 결과 사진 저장 시 최대 픽셀 수 (0 이면 원본 크기로 저장). 초과 시 축소해서 저장
+RESULT_MAX_PIXELS = int(os.environ.get('RESULT_MAX_PIXELS', '0'))
+# 축소 저장 시 원본도 <이름>_original.<확장자> 로 함께 저장할지 여부
+RESULT_KEEP_ORIGINAL = os.environ.get('RESULT_KEEP_ORIGINAL', '0') == '1'
+# 촬영별 결과 사진(<이름>_<토큰>.<확장자>) 보관 기간 (초). 지나면 /result/<토큰> 은 404, 다음 저장 때 삭제
+RESULT_SHOT_TTL = int(os.environ.get('RESULT_SHOT_TTL', '86400'))
+# 결과 사진 다운로드 URL 의 기준 주소 (예: http://192.168.1.23:8888). 비어 있으면 공개 URL 없음
+PUBLIC_BASE_URL = os.environ.get('PUBLIC_BASE_URL', '').rstrip('/')
+
+# JPEG 출력 설정 (JPEG_PROGRESSIVE=1 이면 기본으로 프로그레시브 JPEG 출력)
+JPEG_PROGRESSIVE = os.environ.get('JPEG_PROGRESSIVE', '0') == '1'
+
+
+# 시작 시 한 번 8x8 이미지를 프로그레시브로 인코딩해 SOF2(0xFFC2) 마커가 나오는지 확인
+def _probe_progressive_jpeg():
+    if not hasattr(cv2, 'IMWRITE_JPEG_PROGRESSIVE'):
+        return False
+    try:
+        ok, buffer = cv2.imencode('.jpg', np.zeros((8, 8, 3), np.uint8), [cv2.IMWRITE_JPEG_PROGRESSIVE, 1])
+    except cv2.error:
+        return False
+    if not ok:
+        return False
+
+    # SOS(0xFFDA) 전까지 헤더 세그먼트만 확인
+    data = buffer.tobytes()
+    i = 2
+    while i + 4 <= len(data) and data[i] == 0xFF:
+        marker = data[i + 1]
+        if marker == 0xC2:
+            return True
+        if marker == 0xDA:
+            break
+        i += 2 + int.from_bytes(data[i + 2:i + 4], 'big')
+    return False
+
+
+PROGRESSIVE_JPEG_SUPPORTED = _probe_progressive_jpeg()
+
+
+# 현재 OpenCV 빌드가 프로그레시브 JPEG 인코딩을 지원하는지 여부
+def progressive_jpeg_supported():
+    return PROGRESSIVE_JPEG_SUPPORTED
+
+
+# JPEG 인코딩 함수 (progressive 가 None 이면 서버 기본값 사용)
+def encode_jpg(image, progressive=None):
+    if progressive is None:
+        progressive = JPEG_PROGRESSIVE
+
+    params = []
+    if progressive:
+        if progressive_jpeg_supported():
+            params = [cv2.IMWRITE_JPEG_PROGRESSIVE, 1]
+        else:
+            app.logger.warning("Progressive JPEG is not supported by this OpenCV build. Falling back to baseline.")
+
+    _, buffer = cv2.imencode('.jpg', image, params)
+    return buffer
+
+
+# 이미지가 max_pixels(가로 x 세로)를 넘으면 비율을 유지하며 축소. 확대는 하지 않음
+def fit_pixel_budget(image, max_pixels):
+    if not max_pixels:
+        return image
+
+    height, width = image.shape[:2]
+    if width * height <= max_pixels:
+        return image
+
+    scale = math.sqrt(max_pixels / (width * height))
+    new_width = int(width * scale)
+    new_height = int(height * scale)
+    # 비율이 극단적이면 한 변이 0 이 되므로 1 로 맞추고 나머지 변을 예산 안에서 다시 계산
+    if new_width < 1:
+        new_width = 1
+        new_height = min(height, max_pixels)
+    elif new_height < 1:
+        new_height = 1
+        new_width = min(width, max_pixels)
+    # 부동소수점 오차로 예산을 넘으면 긴 변부터 줄임
+    while new_width * new_height > max_pixels:
+        if new_width >= new_height:
+            new_width -= 1
+        else:
+            new_height -= 1
+    return cv2.resize(image, (new_width, new_height), interpolation=cv2.INTER_AREA)
+
+
+# 촬영마다 결과 사진을 <이름>_<토큰>.<확장자> 로도 남겨 QR 코드가 그 촬영분만 가리키게 함
+latest_result_token = None
+# 결과 사진 토큰 형식 (secrets.token_urlsafe(16) 결과, 22자)
+RESULT_TOKEN_PATTERN = re.compile(r'[A-Za-z0-9_-]{22}')
+
+
+def result_shot_path(token):
+    root, ext = os.path.splitext(RESULT_IMAGE_PATH)
+    return f"{root}_{token}{ext}"
+
+
+# 보관 기간 안의 촬영분이면 파일 경로, 형식이 틀렸거나 없거나 만료됐으면 None
+def find_result_shot(token):
+    if not RESULT_TOKEN_PATTERN.fullmatch(token):
+        return None
+    shot_path = result_shot_path(token)
+    try:
+        saved_at = os.path.getmtime(shot_path)
+    except OSError:
+        return None
+    if time.time() - saved_at > RESULT_SHOT_TTL:
+        return None
+    return shot_path
+
+
+# 보관 기간이 지난 촬영분 삭제
+def prune_result_shots():
+    root, ext = os.path.splitext(RESULT_IMAGE_PATH)
+    result_dir = os.path.dirname(os.path.abspath(RESULT_IMAGE_PATH))
+    prefix = os.path.basename(root) + '_'
+    now = time.time()
+    removed = 0
+    for name in os.listdir(result_dir):
+        if not name.startswith(prefix) or not name.endswith(ext):
+            continue
+        if not RESULT_TOKEN_PATTERN.fullmatch(name[len(prefix):len(name) - len(ext)]):
+            continue
+        shot_path = os.path.join(result_dir, name)
+        try:
+            if now - os.path.getmtime(shot_path) > RESULT_SHOT_TTL:
+                os.remove(shot_path)
+                removed += 1
+        except OSError:
+            pass  # 그 사이 삭제된 파일
+    if removed:
+        app.logger.info(f"Removed {removed} expired result shot(s)")
+
+
+# 결과 사진 저장. RESULT_MAX_PIXELS 를 넘으면 축소해서 저장하고, 설정에 따라 원본도 보관
+def save_result_image(image):
+    global latest_result_token
+    stored_image = fit_pixel_budget(image, RESULT_MAX_PIXELS)
+    root, ext = os.path.splitext(RESULT_IMAGE_PATH)
+    original_path = f"{root}_original{ext}"
+    if stored_image is not image:
+        original_height, original_width = image.shape[:2]
+        stored_height, stored_width = stored_image.shape[:2]
+        app.logger.info(
+            f"Result image downscaled from {original_width}x{original_height} to {stored_width}x{stored_height}"
+        )
+        if RESULT_KEEP_ORIGINAL:
+            cv2.imwrite(original_path, image)
+    elif os.path.exists(original_path):
+        # 축소하지 않은 촬영에서는 이전 촬영의 원본이 남아 있지 않도록 삭제 (저장본이 곧 원본)
+        os.remove(original_path)
+
+    cv2.imwrite(RESULT_IMAGE_PATH, stored_image)
+    token = secrets.token_urlsafe(16)
+    shutil.copyfile(RESULT_IMAGE_PATH, result_shot_path(token))
+    latest_result_token = token
+    prune_result_shots()
+    return token
+
+
+# 손실 WebP 품질 (1~100). 파라미터 없이 인코딩하면 OpenCV 는 무손실 WebP 로 저장하므로 항상 지정
+WEBP_QUALITY = int(os.environ.get('WEBP_QUALITY', '80'))
+
+
+# 클라이언트가 표시할 수 있는 형식(accept) 중 가장 작은 표현 선택
+# WebP 를 받을 수 있으면 WebP 와 JPEG 중 더 작은 쪽, 아니면 JPEG
+def encode_output_image(image, accept=None, progressive=None):
+    jpg_buffer = encode_jpg(image, progressive)
+    if accept and 'image/webp' in accept:
+        ok, webp_buffer = cv2.imencode('.webp', image, [cv2.IMWRITE_WEBP_QUALITY, WEBP_QUALITY])
+        if not ok:
+            app.logger.warning("WebP encoding failed. Falling back to JPEG.")
+        elif len(webp_buffer) < len(jpg_buffer):
+            return webp_buffer, 'image/webp'
+
+    return jpg_buffer, 'image/jpeg'
+
+
+# 허용할 입력 이미지 형식 (쉼표로 구분, 예: ALLOWED_CONTENT_TYPES=image/jpeg,image/png)
+ALLOWED_CONTENT_TYPES = [
+    t.strip().lower()
+    for t in os.environ.get('ALLOWED_CONTENT_TYPES', 'image/jpeg,image/png,image/webp').split(',')
+    if t.strip()
+]
+
+
+# 클라이언트에게 그대로 전달할 수 있는 입력 이미지 거부 사유
+class ImageRejectedError(ValueError):
+    pass
+
+
+# 단계별 소요 시간(ms) 기록 (요청 플래그나 REPORT_TIMINGS=1 일 때만 측정)
+REPORT_TIMINGS = os.environ.get('REPORT_TIMINGS', '0') == '1'
+
+
+# timings 가 None 이면 측정하지 않음
+@contextmanager
+def timed(timings, phase):
+    if timings is None:
+        yield
+        return
+    start = time.perf_counter()
+    try:
+        yield
+    finally:
+        timings[phase] = round((time.perf_counter() - start) * 1000, 3)
+
+
+# 이미지 변환(얼굴 필터, 합성) 동시 실행 수 제한. 업로드 스레드 풀과 별도로 동작
+# 변환은 CPU 를 오래 쓰는 C 코드라 eventlet 허브에 양보하지 않으므로 슬롯 안에서 tpool 의 OS 스레드로 실행
+# FaceMesh 인스턴스를 공유하므로 기본값은 1
+TRANSFORM_CONCURRENCY = int(os.environ.get('TRANSFORM_CONCURRENCY', '1'))
+TRANSFORM_QUEUE_TIMEOUT = float(os.environ.get('TRANSFORM_QUEUE_TIMEOUT', '5'))  # 대기 시간 (초)
+TRANSFORM_QUEUE_CAPACITY = int(os.environ.get('TRANSFORM_QUEUE_CAPACITY', '8'))  # 슬롯 대기 가능 요청 수
+transform_slots = threading.BoundedSemaphore(TRANSFORM_CONCURRENCY)
+transform_stats_lock = threading.Lock()
+transform_stats = {'queued': 0, 'active': 0, 'rejected_busy': 0}
+
+
+class TransformBusyError(ImageRejectedError):
+    pass
+
+
+# 변환 슬롯을 얻을 때까지 최대 TRANSFORM_QUEUE_TIMEOUT 초 대기, 실패 시 TransformBusyError
+# 빈 슬롯이 있으면 바로 실행하고, 기다려야 할 때만 대기열로 계산
+# 이미 TRANSFORM_QUEUE_CAPACITY 만큼 대기 중이면 기다리지 않고 바로 거부
+# timings 가 주어지면 슬롯 대기 시간을 'transform_wait' 로 기록
+@contextmanager
+def transform_slot(timings=None):
+    with timed(timings, 'transform_wait'):
+        acquired = transform_slots.acquire(blocking=False)
+        if not acquired:
+            with transform_stats_lock:
+                if transform_stats['queued'] >= TRANSFORM_QUEUE_CAPACITY:
+                    transform_stats['rejected_busy'] += 1
+                    raise TransformBusyError("Server busy: image transform queue is full. Please retry later.")
+                transform_stats['queued'] += 1
+
+            acquired = transform_slots.acquire(timeout=TRANSFORM_QUEUE_TIMEOUT)
+            with transform_stats_lock:
+                transform_stats['queued'] -= 1
+
+    with transform_stats_lock:
+        if acquired:
+            transform_stats['active'] += 1
+        else:
+            transform_stats['rejected_busy'] += 1
+    if not acquired:
+        raise TransformBusyError("Server busy: too many image transforms in progress. Please retry later.")
+
+    try:
+        yield
+    finally:
+        with transform_stats_lock:
+            transform_stats['active'] -= 1
+        transform_slots.release()
+
+
+def get_transform_stats():
+    with transform_stats_lock:
+        return dict(transform_stats)
+
+
+# 디코딩된 바이트의 시그니처로 실제 이미지 형식 판별
+def sniff_content_type(img_data):
+    if img_data.startswith(b'\xff\xd8\xff'):
+        return 'image/jpeg'
+    if img_data.startswith(b'\x89PNG\r\n\x1a\n'):
+        return 'image/png'
+    if img_data[:4] == b'RIFF' and img_data[8:12] == b'WEBP':
+        return 'image/webp'
+    if img_data[:6] in (b'GIF87a', b'GIF89a'):
+        return 'image/gif'
+    if img_data.startswith(b'BM'):
+        return 'image/bmp'
+    if img_data[:4] in (b'II*\x00', b'MM\x00*'):
+        return 'image/tiff'
+    return 'application/octet-stream'
+
+
+# 디코딩 실패 시 로그에 남길 이미지 세부 정보 (형식, 크기, PNG 비트 깊이 / JPEG 채널 수)
+def describe_image_variant(img_data):
+    content_type = sniff_content_type(img_data)
+    details = [f"type={content_type}", f"bytes={len(img_data)}"]
+
+    if content_type == 'image/png' and len(img_data) >= 26:
+        details.append(f"bit_depth={img_data[24]}")
+        details.append(f"color_type={img_data[25]}")
+    elif content_type == 'image/jpeg':
+        # SOF 마커(0xFFC0 ~ 0xFFCF, DHT/JPG/DAC 제외)에서 채널 수 확인
+        i = 2
+        while i + 9 < len(img_data) and img_data[i] == 0xFF:
+            marker = img_data[i + 1]
+            length = int.from_bytes(img_data[i + 2:i + 4], 'big')
+            if 0xC0 <= marker <= 0xCF and marker not in (0xC4, 0xC8, 0xCC):
+                details.append(f"precision={img_data[i + 4]}")
+                details.append(f"components={img_data[i + 9]}")
+                break
+            i += 2 + length
+
+    return ', '.join(details)
+
+
+def check_content_type(img_data):
+    content_type = sniff_content_type(img_data)
+    if content_type not in ALLOWED_CONTENT_TYPES:
+        raise ImageRejectedError(
+            f"Content type '{content_type}' is not allowed. Allowed types: {', '.join(ALLOWED_CONTENT_TYPES)}"
+        )
+    return content_type
+
+
+# 전체 연결이 공유하는 입력 이미지 대역폭 제한 (토큰 버킷, 초당 바이트)
+class TokenBucket:
+    def __init__(self, rate, capacity):
+        self.rate = rate
+        self.capacity = capacity
+        self.tokens = capacity
+        self.updated = time.monotonic()
+        self.lock = threading.Lock()
+
+    # amount 만큼 토큰을 얻을 때까지 최대 timeout 초 대기. 버킷보다 큰 요청은 가득 찼을 때 허용
+    def acquire(self, amount, timeout):
+        deadline = time.monotonic() + timeout
+        while True:
+            with self.lock:
+                now = time.monotonic()
+                self.tokens = min(self.capacity, self.tokens + (now - self.updated) * self.rate)
+                self.updated = now
+
+                needed = min(amount, self.capacity)
+                if self.tokens >= needed:
+                    self.tokens -= amount
+                    return True
+                wait = (needed - self.tokens) / self.rate
+
+            if now + wait > deadline:
+                return False
+            time.sleep(wait)
+
+
+UPLOAD_BANDWIDTH_LIMIT = int(os.environ.get('UPLOAD_BANDWIDTH_LIMIT', '0'))  # 초당 바이트 (0 이면 제한 없음)
+UPLOAD_BANDWIDTH_TIMEOUT = float(os.environ.get('UPLOAD_BANDWIDTH_TIMEOUT', '2'))  # 대기 시간 (초)
+upload_bucket = TokenBucket(UPLOAD_BANDWIDTH_LIMIT, UPLOAD_BANDWIDTH_LIMIT) if UPLOAD_BANDWIDTH_LIMIT > 0 else None
+
+
+def throttle_upload(nbytes):
+    if upload_bucket and not upload_bucket.acquire(nbytes, UPLOAD_BANDWIDTH_TIMEOUT):
+        raise TransformBusyError("Server busy: upload bandwidth limit reached. Please retry later.")
+
+
+BASE64_ALPHABET = set('ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/')
+BASE64_URLSAFE_ALPHABET = set('ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_')
+
+
+# 공백/줄바꿈을 제거하고 패딩을 보정한 뒤 표준, URL-safe 순서로 base64 디코딩
+# 두 알파벳을 섞어 쓴 입력은 거부. 실패 시 문제가 된 위치와 문자를 담은 ImageRejectedError
+def decode_base64(text):
+    cleaned = ''.join(text.split()).rstrip('=')
+    padded = cleaned + '=' * (-len(cleaned) % 4)
+
+    try:
+        return base64.b64decode(padded, validate=True)
+    except binascii.Error:
+        pass
+    # altchars 는 '-_' 를 '+/' 로 바꾼 뒤 검사하므로 '+/' 가 섞여 있어도 통과됨. 미리 걸러냄
+    if '+' not in cleaned and '/' not in cleaned:
+        try:
+            return base64.b64decode(padded, altchars=b'-_', validate=True)
+        except binascii.Error:
+            pass
+
+    # 원본 문자열 기준으로 잘못된 문자의 위치 찾기 (공백과 끝의 패딩은 허용)
+    body_end = len(text.rstrip().rstrip('='))
+    for offset, char in enumerate(text[:body_end]):
+        if char.isspace():
+            continue
+        if char not in BASE64_ALPHABET and char not in BASE64_URLSAFE_ALPHABET:
+            raise ImageRejectedError(f"Invalid base64 image data: unexpected character {char!r} at offset {offset}")
+    # 표준('+/')과 URL-safe('-_') 문자가 모두 있으면 뒤에 나온 알파벳의 첫 문자를 보고
+    standard_offset = next((i for i, c in enumerate(text[:body_end]) if c in '+/'), None)
+    urlsafe_offset = next((i for i, c in enumerate(text[:body_end]) if c in '-_'), None)
+    if standard_offset is not None and urlsafe_offset is not None:
+        offset = max(standard_offset, urlsafe_offset)
+        raise ImageRejectedError(
+            f"Invalid base64 image data: mixed standard and URL-safe alphabets, {text[offset]!r} at offset {offset}"
+        )
+    if len(cleaned) % 4 == 1:
+        raise ImageRejectedError(
+            f"Invalid base64 image data: truncated input ({len(cleaned)} base64 characters is not a valid length)"
+        )
+    raise ImageRejectedError("Invalid base64 image data")
+
+
+# 입력 이미지 검사 (base64 디코딩 -> 형식 확인 -> 이미지 디코딩). 실패 시 ImageRejectedError
+# throttle 이 True 이면 디코딩된 크기만큼 전체 대역폭 제한을 적용
+def decode_input_image(image_b64, throttle=False, timings=None):
+    with timed(timings, 'base64_decode'):
+        img_data = decode_base64(image_b64)
+
+    if throttle:
+        with timed(timings, 'bandwidth_wait'):
+            throttle_upload(len(img_data))
+
+    with timed(timings, 'validation'):
+        content_type = check_content_type(img_data)
+    with timed(timings, 'image_decode'):
+        np_arr = np.frombuffer(img_data, np.uint8)
+        image = cv2.imdecode(np_arr, cv2.IMREAD_COLOR)
+    if image is None:
+        # 원본 base64 는 hub.input_image_data 에 그대로 남아 있고, 필터 처리만 실패로 처리
+        app.logger.error(f"Failed to decode input image ({describe_image_variant(img_data)})")
+        raise ImageRejectedError("Unsupported image variant: the image could not be decoded for filtering")
+
+    return image, content_type
+
+
+# 저장/필터 처리 없이 입력 이미지 검사 결과만 반환
+# 디코딩 비용은 실제 업로드와 같으므로 전체 대역폭 제한도 똑같이 적용
+def validate_input_image(image_b64):
+    try:
+        image, content_type = decode_input_image(image_b64, throttle=True)
+    except ImageRejectedError as e:
+        return {'valid': False, 'reason': str(e)}
+
+    height, width = image.shape[:2]
+    return {'valid': True, 'content_type': content_type, 'width': width, 'height': height}
+
 
 # 얼굴 각도 계산 함수
 def calculate_face_angle(face_landmarks, image_width, image_height):
@@ -47,10 +492,16 @@ def calculate_face_angle(face_landmarks, image_width, image_height):
         return 0
 
 
+# TRANSFORM_CONCURRENCY 가 1 보다 커도 공유 FaceMesh 는 한 번에 하나씩만 처리
+face_mesh_lock = patcher.original('threading').Lock()
+
+
 # 얼굴 메시 처리 및 필터 적용 함수
 def apply_face_mesh_sync(image, face_mesh, filter_image_path):
     image_height, image_width, _ = image.shape
-    results = face_mesh.process(image)
+    # tpool 의 OS 스레드에서 호출되므로 패치되지 않은 원래 threading 의 락 사용
+    with face_mesh_lock:
+        results = face_mesh.process(image)
 
     if results.multi_face_landmarks:
         for face_landmarks in results.multi_face_landmarks:
@@ -113,13 +564,14 @@ async def in_image(data):
 
 def end(data):
     try:
-        end_frame = base64.b64decode(data['end_frame'] + '==')
-        end_img1 = base64.b64decode(data['end_img1'] + '==')
-        end_img2 = base64.b64decode(data['end_img2'] + '==')
-        temp.img_connect(end_frame, end_img1, end_img2)
+        end_frame = decode_base64(data['end_frame'])
+        end_img1 = decode_base64(data['end_img1'])
+        end_img2 = decode_base64(data['end_img2'])
+        with transform_slot():
+            tpool.execute(temp.img_connect, end_frame, end_img1, end_img2)
 
         image = cv2.imread('img/end.jpg')
-        _, buffer = cv2.imencode(".jpg", image)
+        buffer = encode_jpg(image, data.get('progressive'))
         jpg_as_text = base64.b64encode(buffer).decode('utf-8')
 
         app.end(jpg_as_text)
@@ -199,16 +651,40 @@ def convert_image_to_qr(image_path, output_path):
     except Exception as e:
         print(f"오류 발생: {e}")
 
+
+QR_ERROR_CORRECTION = {
+    'L': qrcode.constants.ERROR_CORRECT_L,
+    'M': qrcode.constants.ERROR_CORRECT_M,
+    'Q': qrcode.constants.ERROR_CORRECT_Q,
+    'H': qrcode.constants.ERROR_CORRECT_H,
+}
+
+
+# URL 을 담은 QR 코드를 PNG 바이트로 생성
+def make_url_qr(url, box_size=10, error_correction='L'):
+    qr = qrcode.QRCode(
+        version=None,  # URL 길이에 맞춰 자동 결정
+        error_correction=QR_ERROR_CORRECTION[error_correction],
+        box_size=box_size,
+        border=4,
+    )
+    qr.add_data(url)
+    qr.make(fit=True)
+
+    qr_image = qr.make_image(fill_color="black", back_color="white")
+    with BytesIO() as buffer:
+        qr_image.save(buffer)
+        return buffer.getvalue()
+
 def input(data, temp):
+    report_timings = data.get('timings')
+    timings = {} if (REPORT_TIMINGS if report_timings is None else report_timings) else None
+    start = time.perf_counter()
     try:
-        img_data = base64.b64decode(data['image'] + '==')
-        np_arr = np.frombuffer(img_data, np.uint8)
-        image = cv2.imdecode(np_arr, cv2.IMREAD_COLOR)
+        image, _ = decode_input_image(data['image'], throttle=True, timings=timings)
         filter_number = data.get('filter_number', 0)
         app.logger.info(f"Received filter number: {filter_number}")
 
-        FILTER_DIRECTORY = r'C:\Users\kyle0\Desktop\trick-or-picture-main\trick-or-picture-main\img'  # 필터 이미지 디렉토리
-
         filter_image = os.path.join(FILTER_DIRECTORY, f"{filter_number}.png")  # 경로 안전하게 결합
         print(f"Trying to find filter image at: {filter_image}")
 
@@ -223,29 +699,42 @@ def input(data, temp):
         image = cv2.cvtColor(image, cv2.COLOR_BGR2RGB)
         image.flags.writeable = True
 
-        # 비동기로 이미지 처리
-        processed_image = apply_face_mesh(image, face_mesh, filter_image_path)
+        # 변환 슬롯을 잡은 채 OS 스레드에서 처리 (그동안 다른 요청은 슬롯 대기열에서 기다림)
+        with transform_slot(timings), timed(timings, 'transform'):
+            processed_image = tpool.execute(apply_face_mesh, image, face_mesh, filter_image_path)
 
         # RGB에서 BGR로 변환
         processed_image = cv2.cvtColor(processed_image, cv2.COLOR_RGB2BGR)
 
         if temp:
             app.logger.info("save image to res_img")
-            cv2.imwrite(r'../res_img/res.png', processed_image)
+            with timed(timings, 'storage_write'):
+                save_result_image(processed_image)
             #convert_image_to_qr("../res_img/res.png", "../qrcode/qr.png")
 
+        # 저장 크기는 RESULT_MAX_PIXELS 를 따르고, 전송할 이미지는 요청한 픽셀 예산(max_pixels)에 맞춰 따로 축소
+        with timed(timings, 'resize'):
+            processed_image = fit_pixel_budget(processed_image, data.get('max_pixels'))
 
         # 필터링된 이미지를 Base64로 인코딩
-        _, buffer = cv2.imencode('.jpg', processed_image)
-        jpg_as_text = base64.b64encode(buffer).decode('utf-8')
+        with timed(timings, 'encode'):
+            buffer, content_type = encode_output_image(processed_image, data.get('accept'), data.get('progressive'))
+            jpg_as_text = base64.b64encode(buffer).decode('utf-8')
+
+        if timings is not None:
+            timings['total'] = round((time.perf_counter() - start) * 1000, 3)
 
         app.logger.info("Processed image sent successfully.")
         #print(jpg_as_text)
-        return jpg_as_text
+        return jpg_as_text, content_type, timings
 
 
+    except ImageRejectedError as e:
+        app.logger.warning(f"Input image not processed: {e}")
+        raise
     except Exception as e:
         app.logger.error(f"Error during image processing: {e}")
+        return None, None, None
 
 '''
 def main():